@@ -0,0 +1,346 @@
+package reverseproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"hash/fnv"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sync/atomic"
+	"time"
+)
+
+// BalancePolicy selects how a Backend distributes requests across its
+// Targets.
+type BalancePolicy int
+
+const (
+	// RoundRobin cycles through healthy targets in order.
+	RoundRobin BalancePolicy = iota
+	// Random picks a healthy target uniformly at random.
+	Random
+	// LeastConnections picks the healthy target with the fewest
+	// in-flight requests.
+	LeastConnections
+	// IPHash picks a healthy target by hashing the client's address,
+	// so a given client sticks to the same target while it stays up.
+	IPHash
+)
+
+// HealthCheckConfig configures the background prober that marks
+// Backend targets up or down.
+type HealthCheckConfig struct {
+	// Path is requested on each target at Interval; any 2xx response
+	// within Timeout is considered healthy.
+	Path     string
+	Interval time.Duration
+	Timeout  time.Duration
+}
+
+// Backend is a set of upstream targets proxied as one logical
+// service.
+type Backend struct {
+	Targets     []*url.URL
+	Policy      BalancePolicy
+	HealthCheck *HealthCheckConfig
+
+	// MaxRetries bounds how many times a failed request to one
+	// target is retried against another healthy target. Only
+	// idempotent methods (GET, HEAD, OPTIONS) are retried.
+	MaxRetries int
+}
+
+// backendTarget tracks liveness and load for one Backend.Targets
+// entry.
+type backendTarget struct {
+	url      *url.URL
+	inFlight int64
+	healthy  int32 // atomic bool, 1 = healthy
+}
+
+func newBackendTarget(u *url.URL) *backendTarget {
+	return &backendTarget{url: u, healthy: 1}
+}
+
+func (t *backendTarget) isHealthy() bool { return atomic.LoadInt32(&t.healthy) == 1 }
+func (t *backendTarget) setHealthy(ok bool) {
+	v := int32(0)
+	if ok {
+		v = 1
+	}
+	atomic.StoreInt32(&t.healthy, v)
+}
+
+// loadBalancer implements the per-request target selection and
+// health tracking for a Backend.
+type loadBalancer struct {
+	backend *Backend
+	targets []*backendTarget
+	next    uint64 // round-robin cursor
+}
+
+func newLoadBalancer(b *Backend) *loadBalancer {
+	lb := &loadBalancer{backend: b}
+	for _, t := range b.Targets {
+		lb.targets = append(lb.targets, newBackendTarget(t))
+	}
+	return lb
+}
+
+func (lb *loadBalancer) healthyTargets() []*backendTarget {
+	var healthy []*backendTarget
+	for _, t := range lb.targets {
+		if t.isHealthy() {
+			healthy = append(healthy, t)
+		}
+	}
+	if len(healthy) == 0 {
+		// Fail open: with nothing known healthy, try everything
+		// rather than refusing all traffic.
+		return lb.targets
+	}
+	return healthy
+}
+
+// pick selects a target for req, excluding any target in exclude.
+func (lb *loadBalancer) pick(req *http.Request, exclude map[*backendTarget]bool) *backendTarget {
+	candidates := lb.healthyTargets()
+	if exclude != nil {
+		filtered := candidates[:0:0]
+		for _, t := range candidates {
+			if !exclude[t] {
+				filtered = append(filtered, t)
+			}
+		}
+		if len(filtered) > 0 {
+			candidates = filtered
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	switch lb.backend.Policy {
+	case Random:
+		return candidates[rand.Intn(len(candidates))]
+	case LeastConnections:
+		best := candidates[0]
+		for _, t := range candidates[1:] {
+			if atomic.LoadInt64(&t.inFlight) < atomic.LoadInt64(&best.inFlight) {
+				best = t
+			}
+		}
+		return best
+	case IPHash:
+		host, _, err := net.SplitHostPort(req.RemoteAddr)
+		if err != nil {
+			host = req.RemoteAddr
+		}
+		h := fnv.New32a()
+		h.Write([]byte(host))
+		return candidates[int(h.Sum32())%len(candidates)]
+	default: // RoundRobin
+		i := atomic.AddUint64(&lb.next, 1)
+		return candidates[int(i)%len(candidates)]
+	}
+}
+
+// runHealthChecks probes every target on Interval until stop is
+// closed. It is meant to run in its own goroutine. tlsCfg is the same
+// TLS client config used for proxying, so https targets with a custom
+// CA/cert aren't marked down by the checker's own connections.
+func (lb *loadBalancer) runHealthChecks(stop <-chan struct{}, tlsCfg *tls.Config) {
+	cfg := lb.backend.HealthCheck
+	if cfg == nil || cfg.Path == "" {
+		return
+	}
+	interval := cfg.Interval
+	if interval <= 0 {
+		interval = time.Second * 10
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	timeout := cfg.Timeout
+	if timeout <= 0 {
+		timeout = time.Second * 5
+	}
+	client := &http.Client{
+		Timeout:   timeout,
+		Transport: &http.Transport{TLSClientConfig: tlsCfg},
+	}
+
+	check := func(t *backendTarget) {
+		u := *t.url
+		u.Path = cfg.Path
+		resp, err := client.Get(u.String())
+		if err != nil {
+			t.setHealthy(false)
+			return
+		}
+		resp.Body.Close()
+		t.setHealthy(resp.StatusCode >= 200 && resp.StatusCode < 300)
+	}
+
+	for _, t := range lb.targets {
+		check(t)
+	}
+
+	for {
+		select {
+		case <-ticker.C:
+			for _, t := range lb.targets {
+				check(t)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// idempotentMethods are safe to retry against a different target
+// after a transport-level failure.
+var idempotentMethods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodOptions: true,
+}
+
+type backendTargetKey struct{}
+type origRequestKey struct{}
+
+// origRequest snapshots the fields of the inbound request that
+// forwarded-header and header-hook computation reads, captured before
+// the first Rewrite pass mutates them. Each Rewrite invocation
+// (including retries) recomputes from this pristine snapshot rather
+// than the previous attempt's already-mutated request, so retries
+// don't accumulate duplicate X-Forwarded-For entries or repeated
+// "add" header ops.
+type origRequest struct {
+	header http.Header
+	url    url.URL
+	host   string
+}
+
+// NewLoadBalancedReverseProxy returns a ReverseProxy that distributes
+// requests across b.Targets according to b.Policy, retrying failed
+// idempotent requests against another healthy target up to
+// b.MaxRetries times, and running a background health checker when
+// b.HealthCheck is set.
+func NewLoadBalancedReverseProxy(b *Backend, tlsCfg *tls.Config) *ReverseProxy {
+	lb := newLoadBalancer(b)
+
+	base := &httputil.ReverseProxy{}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if tlsCfg != nil {
+		transport.TLSClientConfig = tlsCfg
+	}
+	base.Transport = transport
+
+	p := &ReverseProxy{ReverseProxy: base, tlsClientConfig: tlsCfg}
+	p.pickTarget = func(req *http.Request) *url.URL {
+		target := lb.pick(req, nil)
+		if target == nil {
+			return nil
+		}
+		return target.url
+	}
+
+	// Rewrite, not Director: see setForwardedHeaders.
+	base.Director = nil
+	base.Rewrite = func(pr *httputil.ProxyRequest) {
+		orig, ok := pr.In.Context().Value(origRequestKey{}).(*origRequest)
+		if !ok {
+			orig = &origRequest{header: pr.In.Header.Clone(), url: *pr.In.URL, host: pr.In.Host}
+			pr.Out = pr.Out.WithContext(context.WithValue(pr.Out.Context(), origRequestKey{}, orig))
+		}
+
+		exclude, _ := pr.In.Context().Value(backendTargetKey{}).(map[*backendTarget]bool)
+		target := lb.pick(pr.In, exclude)
+		if target == nil {
+			return
+		}
+
+		// Recompute from the pristine snapshot every time, so a retry
+		// never layers new forwarded-header/header-hook state on top
+		// of the previous attempt's already-mutated request.
+		pr.Out.Header = orig.header.Clone()
+		u := orig.url
+		pr.Out.URL = &u
+		pr.Out.Host = orig.host
+
+		pr.Out.URL.Scheme = target.url.Scheme
+		pr.Out.URL.Host = target.url.Host
+		pr.Out.Host = target.url.Host
+
+		// Pass pr.Out, not pr.In, as the header source: pr.Out.Header was
+		// just reset to the pristine orig snapshot above, while pr.In is
+		// the previous attempt's already-mutated outreq on a retry (it
+		// would otherwise report the prior attempt's appended hop as a
+		// client-supplied X-Forwarded-For value and double it).
+		peerTrusted := trustedPeer(pr.In.RemoteAddr, p.TrustedProxies)
+		setForwardedHeaders(pr.Out, pr.Out, peerTrusted)
+		removeHopByHopHeaders(pr.Out.Header)
+		applyHeaderOps(pr.Out.Header, p.RequestHeaders)
+
+		atomic.AddInt64(&target.inFlight, 1)
+		pr.Out = pr.Out.WithContext(context.WithValue(pr.Out.Context(), currentTargetKey{}, target))
+	}
+
+	base.ModifyResponse = func(resp *http.Response) error {
+		if target, ok := resp.Request.Context().Value(currentTargetKey{}).(*backendTarget); ok {
+			atomic.AddInt64(&target.inFlight, -1)
+		}
+		applyHeaderOps(resp.Header, p.ResponseHeaders)
+		if p.ModifyResponse != nil {
+			return p.ModifyResponse(resp)
+		}
+		return nil
+	}
+
+	base.ErrorHandler = func(rw http.ResponseWriter, req *http.Request, err error) {
+		target, _ := req.Context().Value(currentTargetKey{}).(*backendTarget)
+		if target != nil {
+			atomic.AddInt64(&target.inFlight, -1)
+			target.setHealthy(false)
+		}
+
+		retries, _ := req.Context().Value(retryCountKey{}).(int)
+		if idempotentMethods[req.Method] && retries < b.MaxRetries {
+			exclude, _ := req.Context().Value(backendTargetKey{}).(map[*backendTarget]bool)
+			if exclude == nil {
+				exclude = make(map[*backendTarget]bool)
+			} else {
+				clone := make(map[*backendTarget]bool, len(exclude)+1)
+				for k := range exclude {
+					clone[k] = true
+				}
+				exclude = clone
+			}
+			if target != nil {
+				exclude[target] = true
+			}
+
+			ctx := context.WithValue(req.Context(), backendTargetKey{}, exclude)
+			ctx = context.WithValue(ctx, retryCountKey{}, retries+1)
+			retryReq := req.Clone(ctx)
+			p.ReverseProxy.ServeHTTP(rw, retryReq)
+			return
+		}
+
+		p.logf("http: proxy error: %v", err)
+		rw.WriteHeader(http.StatusBadGateway)
+	}
+
+	p.healthStop = make(chan struct{})
+	go lb.runHealthChecks(p.healthStop, tlsCfg)
+
+	return p
+}
+
+type currentTargetKey struct{}
+type retryCountKey struct{}
@@ -0,0 +1,124 @@
+package reverseproxy
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+)
+
+func TestLoadBalancerRoundRobinDistributes(t *testing.T) {
+	b := &Backend{
+		Targets: []*url.URL{
+			{Scheme: "http", Host: "a.internal"},
+			{Scheme: "http", Host: "b.internal"},
+		},
+		Policy: RoundRobin,
+	}
+	lb := newLoadBalancer(b)
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+
+	seen := map[string]int{}
+	for i := 0; i < 4; i++ {
+		target := lb.pick(req, nil)
+		seen[target.url.Host]++
+	}
+
+	if seen["a.internal"] != 2 || seen["b.internal"] != 2 {
+		t.Errorf("round robin did not distribute evenly: %v", seen)
+	}
+}
+
+// TestNewLoadBalancedReverseProxyRetriesOnFailedTarget checks that a
+// request which lands on an unreachable target is retried against
+// another healthy target rather than failing outright.
+func TestNewLoadBalancedReverseProxyRetriesOnFailedTarget(t *testing.T) {
+	var calls int32
+	good := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.Write([]byte("ok"))
+	}))
+	defer good.Close()
+
+	goodURL, err := url.Parse(good.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Nothing listens here; dialing it fails fast with connection refused.
+	badURL, err := url.Parse("http://127.0.0.1:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := &Backend{
+		Targets:    []*url.URL{badURL, badURL, goodURL},
+		Policy:     RoundRobin,
+		MaxRetries: 2,
+	}
+	p := NewLoadBalancedReverseProxy(b, nil)
+	defer p.StopHealthChecks()
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "127.0.0.1:9999"
+	rw := httptest.NewRecorder()
+	p.ServeHTTP(rw, req)
+
+	if rw.Code != http.StatusOK {
+		t.Fatalf("expected %d after retrying past failed targets, got %d: %s", http.StatusOK, rw.Code, rw.Body.String())
+	}
+	if atomic.LoadInt32(&calls) == 0 {
+		t.Error("expected the healthy target to be reached")
+	}
+}
+
+// TestNewLoadBalancedReverseProxyRetriesDoNotAccumulateXFF checks that
+// retrying past a failed target recomputes X-Forwarded-For from the
+// pristine pre-Rewrite snapshot rather than the previous attempt's
+// already-appended outreq, for a trusted peer whose prior chain must
+// be preserved (not just not doubled).
+func TestNewLoadBalancedReverseProxyRetriesDoNotAccumulateXFF(t *testing.T) {
+	var gotXFF string
+	good := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotXFF = r.Header.Get("X-Forwarded-For")
+		w.Write([]byte("ok"))
+	}))
+	defer good.Close()
+
+	goodURL, err := url.Parse(good.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	badURL, err := url.Parse("http://127.0.0.1:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, trustedNet, err := net.ParseCIDR("127.0.0.1/32")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := &Backend{
+		Targets:    []*url.URL{badURL, goodURL},
+		Policy:     RoundRobin,
+		MaxRetries: 1,
+	}
+	p := NewLoadBalancedReverseProxy(b, nil)
+	defer p.StopHealthChecks()
+	p.TrustedProxies = []*net.IPNet{trustedNet}
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "127.0.0.1:9999"
+	req.Header.Set("X-Forwarded-For", "1.2.3.4")
+	rw := httptest.NewRecorder()
+	p.ServeHTTP(rw, req)
+
+	if rw.Code != http.StatusOK {
+		t.Fatalf("expected %d after retrying past failed target, got %d: %s", http.StatusOK, rw.Code, rw.Body.String())
+	}
+	if want := "1.2.3.4, 127.0.0.1"; gotXFF != want {
+		t.Errorf("X-Forwarded-For = %q, want %q (retry must not drop or duplicate the prior chain)", gotXFF, want)
+	}
+}
@@ -0,0 +1,116 @@
+package reverseproxy
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// hopByHopHeaders are stripped from the outbound request in addition
+// to whatever the client's own Connection header lists, per RFC 7230
+// §6.1.
+var hopByHopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// removeHopByHopHeaders deletes the standard hop-by-hop headers plus
+// any header named in the request's Connection header.
+func removeHopByHopHeaders(h http.Header) {
+	if c := h.Get("Connection"); c != "" {
+		for _, name := range strings.Split(c, ",") {
+			h.Del(strings.TrimSpace(name))
+		}
+	}
+	for _, name := range hopByHopHeaders {
+		h.Del(name)
+	}
+}
+
+// trustedPeer reports whether remoteAddr's host matches one of
+// trusted. An empty trusted list trusts no one.
+func trustedPeer(remoteAddr string, trusted []*net.IPNet) bool {
+	if len(trusted) == 0 {
+		return false
+	}
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, n := range trusted {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// setForwardedHeaders updates X-Forwarded-For, X-Forwarded-Proto,
+// X-Forwarded-Host, and the RFC 7239 Forwarded header on outreq based
+// on the original (pre-rewrite) request req. peerTrusted reports
+// whether req.RemoteAddr is a trusted proxy; when it is not, any
+// client-supplied X-Forwarded-For / Forwarded values are discarded
+// before the current hop is appended, preventing IP spoofing.
+//
+// Callers must invoke this from a ReverseProxy Rewrite func, not a
+// Director: when Director is set, httputil.ReverseProxy.ServeHTTP
+// unconditionally appends the client IP to X-Forwarded-For itself
+// after Director returns, which would double the entry this function
+// computes.
+func setForwardedHeaders(outreq, req *http.Request, peerTrusted bool) {
+	clientIP, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		clientIP = req.RemoteAddr
+	}
+
+	// Read from req (pr.In), not outreq: a ReverseProxy.Rewrite func
+	// (which this must be called from) receives outreq with
+	// X-Forwarded-For already stripped by httputil.ReverseProxy, so any
+	// client-supplied value or explicit opt-out sentinel only survives
+	// on the pre-rewrite req.
+	prior, explicitOptOut := req.Header["X-Forwarded-For"]
+	omit := explicitOptOut && prior == nil
+	if !peerTrusted {
+		prior = nil
+	}
+
+	if clientIP != "" {
+		xff := clientIP
+		if len(prior) > 0 {
+			xff = strings.Join(prior, ", ") + ", " + clientIP
+		}
+		if !omit {
+			outreq.Header.Set("X-Forwarded-For", xff)
+		}
+	}
+
+	proto := "http"
+	if req.TLS != nil {
+		proto = "https"
+	}
+	if !peerTrusted || outreq.Header.Get("X-Forwarded-Proto") == "" {
+		outreq.Header.Set("X-Forwarded-Proto", proto)
+	}
+	if !peerTrusted || outreq.Header.Get("X-Forwarded-Host") == "" {
+		outreq.Header.Set("X-Forwarded-Host", req.Host)
+	}
+
+	forwarded := "for=" + clientIP + ";host=" + req.Host + ";proto=" + proto
+	if peerTrusted {
+		if existing := req.Header.Get("Forwarded"); existing != "" {
+			forwarded = existing + ", " + forwarded
+		}
+	}
+	outreq.Header.Set("Forwarded", forwarded)
+}
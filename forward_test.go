@@ -0,0 +1,195 @@
+package reverseproxy
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestSetForwardedHeadersUntrustedPeerDiscardsClientXFF(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "203.0.113.5:4444"
+	req.Header.Set("X-Forwarded-For", "1.2.3.4") // client-supplied, must be discarded
+
+	outreq := req.Clone(req.Context())
+	setForwardedHeaders(outreq, req, false)
+
+	if got, want := outreq.Header.Get("X-Forwarded-For"), "203.0.113.5"; got != want {
+		t.Errorf("X-Forwarded-For = %q, want %q (client-supplied value discarded)", got, want)
+	}
+}
+
+func TestSetForwardedHeadersTrustedPeerAppends(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "127.0.0.1:4444"
+	req.Header.Set("X-Forwarded-For", "1.2.3.4")
+
+	outreq := req.Clone(req.Context())
+	setForwardedHeaders(outreq, req, true)
+
+	if got, want := outreq.Header.Get("X-Forwarded-For"), "1.2.3.4, 127.0.0.1"; got != want {
+		t.Errorf("X-Forwarded-For = %q, want %q", got, want)
+	}
+}
+
+func TestSetForwardedHeadersExplicitOptOut(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "127.0.0.1:4444"
+	req.Header["X-Forwarded-For"] = nil // opt-out sentinel, read from req (pr.In)
+
+	outreq := req.Clone(req.Context())
+	setForwardedHeaders(outreq, req, true)
+
+	if got := outreq.Header.Get("X-Forwarded-For"); got != "" {
+		t.Errorf("X-Forwarded-For = %q, want empty after explicit opt-out", got)
+	}
+}
+
+// The following tests drive a real upstream through ServeHTTP/ProxyHTTP
+// on each of the three entry points that install X-Forwarded-For
+// handling, rather than calling setForwardedHeaders directly. A
+// ReverseProxy wired through Director instead of Rewrite passes the
+// unit tests above (they call setForwardedHeaders in isolation) but
+// still double-appends the client IP in the real stdlib pipeline,
+// since httputil.ReverseProxy.ServeHTTP runs its own legacy XFF logic
+// after Director returns.
+
+func TestNewReverseProxyXFFNotDoubled(t *testing.T) {
+	var gotXFF string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotXFF = r.Header.Get("X-Forwarded-For")
+		w.Write([]byte("ok"))
+	}))
+	defer upstream.Close()
+
+	target, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := NewReverseProxy(target, nil)
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "127.0.0.1:4444"
+	rw := httptest.NewRecorder()
+	p.ProxyHTTP(rw, req)
+
+	if want := "127.0.0.1"; gotXFF != want {
+		t.Errorf("X-Forwarded-For = %q, want %q (got doubled if it appears twice)", gotXFF, want)
+	}
+}
+
+func TestRouterXFFNotDoubled(t *testing.T) {
+	var gotXFF string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotXFF = r.Header.Get("X-Forwarded-For")
+		w.Write([]byte("ok"))
+	}))
+	defer upstream.Close()
+
+	target, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewRouter()
+	if err := r.Register("example.com", "/", RouteConfig{Target: target}); err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Host = "example.com"
+	req.RemoteAddr = "127.0.0.1:4444"
+	rw := httptest.NewRecorder()
+	r.ServeHTTP(rw, req)
+
+	if want := "127.0.0.1"; gotXFF != want {
+		t.Errorf("X-Forwarded-For = %q, want %q (got doubled if it appears twice)", gotXFF, want)
+	}
+}
+
+func TestNewLoadBalancedReverseProxyXFFNotDoubled(t *testing.T) {
+	var gotXFF string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotXFF = r.Header.Get("X-Forwarded-For")
+		w.Write([]byte("ok"))
+	}))
+	defer upstream.Close()
+
+	target, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := &Backend{Targets: []*url.URL{target}, Policy: RoundRobin}
+	p := NewLoadBalancedReverseProxy(b, nil)
+	defer p.StopHealthChecks()
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "127.0.0.1:4444"
+	rw := httptest.NewRecorder()
+	p.ServeHTTP(rw, req)
+
+	if want := "127.0.0.1"; gotXFF != want {
+		t.Errorf("X-Forwarded-For = %q, want %q (got doubled if it appears twice)", gotXFF, want)
+	}
+}
+
+// TestNewReverseProxyTrustedPeerPreservesPriorXFF checks that a
+// trusted peer's existing X-Forwarded-For chain survives the real
+// stdlib Rewrite pipeline, which strips X-Forwarded-For from outreq
+// before Rewrite runs; setForwardedHeaders must read the prior value
+// from the pre-rewrite request, not the already-stripped one.
+func TestNewReverseProxyTrustedPeerPreservesPriorXFF(t *testing.T) {
+	var gotXFF string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotXFF = r.Header.Get("X-Forwarded-For")
+		w.Write([]byte("ok"))
+	}))
+	defer upstream.Close()
+
+	target, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, trustedNet, err := net.ParseCIDR("127.0.0.1/32")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := NewReverseProxy(target, nil)
+	p.TrustedProxies = []*net.IPNet{trustedNet}
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "127.0.0.1:4444"
+	req.Header.Set("X-Forwarded-For", "1.2.3.4")
+	rw := httptest.NewRecorder()
+	p.ProxyHTTP(rw, req)
+
+	if want := "1.2.3.4, 127.0.0.1"; gotXFF != want {
+		t.Errorf("X-Forwarded-For = %q, want %q", gotXFF, want)
+	}
+}
+
+func TestRemoveHopByHopHeaders(t *testing.T) {
+	h := http.Header{}
+	h.Set("Connection", "X-Custom-Hop")
+	h.Set("X-Custom-Hop", "should be removed")
+	h.Set("Keep-Alive", "timeout=5")
+	h.Set("X-Keep", "should remain")
+
+	removeHopByHopHeaders(h)
+
+	if h.Get("X-Custom-Hop") != "" {
+		t.Error("header named by Connection should be removed")
+	}
+	if h.Get("Keep-Alive") != "" {
+		t.Error("standard hop-by-hop header should be removed")
+	}
+	if h.Get("X-Keep") == "" {
+		t.Error("unrelated header should survive")
+	}
+}
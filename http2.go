@@ -0,0 +1,23 @@
+package reverseproxy
+
+import (
+	"net/http"
+
+	"golang.org/x/net/http2"
+)
+
+// configureHTTP2Once calls http2.ConfigureTransport on the proxy's
+// *http.Transport the first time it runs, enabling h2 upstream
+// negotiation. It is a no-op for any other RoundTripper, since those
+// are assumed to already manage their own protocol support.
+func (p *ReverseProxy) configureHTTP2Once() {
+	p.h2once.Do(func() {
+		t, ok := p.Transport.(*http.Transport)
+		if !ok {
+			return
+		}
+		if err := http2.ConfigureTransport(t); err != nil {
+			p.logf("http2: configure transport: %v", err)
+		}
+	})
+}
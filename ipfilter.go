@@ -0,0 +1,389 @@
+package reverseproxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// FilterMode selects how IPFilter evaluates incoming connections.
+type FilterMode int
+
+const (
+	// FilterDisabled lets every request through.
+	FilterDisabled FilterMode = iota
+	// FilterWhitelist rejects anything not in WhiteCIDRs.
+	FilterWhitelist
+	// FilterBlacklist rejects anything in BlackCIDRs.
+	FilterBlacklist
+	// FilterBoth applies both the whitelist and the blacklist: the
+	// address must be in WhiteCIDRs and must not be in BlackCIDRs.
+	FilterBoth
+)
+
+// IPFilter enforces allow/deny rules on the direct RemoteAddr and,
+// when the peer is a trusted proxy, on the client address parsed from
+// X-Forwarded-For.
+type IPFilter struct {
+	Mode FilterMode
+
+	WhiteCIDRs []string
+	BlackCIDRs []string
+
+	// TrustedProxies lists CIDRs whose X-Forwarded-For chain may be
+	// trusted for filtering purposes.
+	TrustedProxies []string
+
+	// MustKeyHeader/MustKeyValue, when both set, require the named
+	// header to carry the given value for the request to pass,
+	// regardless of IP rules (useful for a shared bypass secret).
+	MustKeyHeader string
+	MustKeyValue  string
+
+	// RejectStatus and RejectBody are served instead of a bare 403
+	// when a request is rejected. RejectStatus defaults to
+	// http.StatusForbidden and RejectBody to a small default page.
+	RejectStatus int
+	RejectBody   string
+
+	mu            sync.RWMutex
+	white         *cidrSet
+	black         *cidrSet
+	trust         *cidrSet
+	compiled      bool
+	compileBroken bool
+
+	// whiteCIDRFile/blackCIDRFile record the path last passed to
+	// LoadCIDRFile, if any, so Reload (and ReloadOnSIGHUP) can re-read
+	// the file from disk instead of just recompiling whatever CIDRs
+	// are already sitting in WhiteCIDRs/BlackCIDRs.
+	whiteCIDRFile string
+	blackCIDRFile string
+}
+
+// cidrSet indexes CIDR blocks by prefix length, one sorted slice of
+// masked network addresses per length. A lookup masks the candidate
+// IP once per distinct prefix length present in the set and binary
+// searches that length's bucket, so cost is O(k log n) for k distinct
+// prefix lengths and n total entries, rather than a full linear scan.
+type cidrSet struct {
+	v4 map[int][]uint32   // prefix length -> sorted masked /32 network addrs
+	v6 map[int][][16]byte // prefix length -> sorted masked /128 network addrs
+}
+
+func newCIDRSet(cidrs []string) (*cidrSet, error) {
+	s := &cidrSet{v4: make(map[int][]uint32), v6: make(map[int][][16]byte)}
+	for _, c := range cidrs {
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, fmt.Errorf("reverseproxy: invalid CIDR %q: %w", c, err)
+		}
+		ones, _ := n.Mask.Size()
+
+		if ip4 := n.IP.To4(); ip4 != nil {
+			s.v4[ones] = append(s.v4[ones], binary.BigEndian.Uint32(ip4))
+			continue
+		}
+		var b [16]byte
+		copy(b[:], n.IP.To16())
+		s.v6[ones] = append(s.v6[ones], b)
+	}
+
+	for ones, bucket := range s.v4 {
+		sort.Slice(bucket, func(i, j int) bool { return bucket[i] < bucket[j] })
+		s.v4[ones] = bucket
+	}
+	for ones, bucket := range s.v6 {
+		sort.Slice(bucket, func(i, j int) bool { return bytes.Compare(bucket[i][:], bucket[j][:]) < 0 })
+		s.v6[ones] = bucket
+	}
+
+	return s, nil
+}
+
+// v4Mask returns the /ones network mask for an IPv4 address as a
+// uint32, e.g. ones=24 -> 0xFFFFFF00.
+func v4Mask(ones int) uint32 {
+	if ones <= 0 {
+		return 0
+	}
+	if ones >= 32 {
+		return 0xFFFFFFFF
+	}
+	return ^uint32(0) << (32 - ones)
+}
+
+// maskV6 masks a 16-byte IPv6 address to its first ones bits.
+func maskV6(b [16]byte, ones int) [16]byte {
+	var out [16]byte
+	full := ones / 8
+	copy(out[:full], b[:full])
+	if rem := ones % 8; rem != 0 && full < 16 {
+		out[full] = b[full] & (^byte(0) << (8 - rem))
+	}
+	return out
+}
+
+// contains reports whether ip falls in any network of the set.
+func (s *cidrSet) contains(ip net.IP) bool {
+	if s == nil {
+		return false
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		val := binary.BigEndian.Uint32(ip4)
+		for ones, bucket := range s.v4 {
+			masked := val & v4Mask(ones)
+			i := sort.Search(len(bucket), func(i int) bool { return bucket[i] >= masked })
+			if i < len(bucket) && bucket[i] == masked {
+				return true
+			}
+		}
+		return false
+	}
+
+	var b [16]byte
+	copy(b[:], ip.To16())
+	for ones, bucket := range s.v6 {
+		masked := maskV6(b, ones)
+		i := sort.Search(len(bucket), func(i int) bool {
+			return bytes.Compare(bucket[i][:], masked[:]) >= 0
+		})
+		if i < len(bucket) && bucket[i] == masked {
+			return true
+		}
+	}
+	return false
+}
+
+// compile (re)builds the internal CIDR sets from the string fields.
+// Call it after constructing an IPFilter or changing its CIDR lists
+// directly; Reload and hot-reload-from-file both call it for you.
+func (f *IPFilter) compile() error {
+	white, err := newCIDRSet(f.WhiteCIDRs)
+	if err != nil {
+		return err
+	}
+	black, err := newCIDRSet(f.BlackCIDRs)
+	if err != nil {
+		return err
+	}
+	trust, err := newCIDRSet(f.TrustedProxies)
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	f.white, f.black, f.trust = white, black, trust
+	f.compiled = true
+	f.compileBroken = false
+	f.mu.Unlock()
+
+	return nil
+}
+
+// ensureCompiled compiles the filter's CIDR sets on first use, so an
+// IPFilter built as a struct literal (the documented usage) and never
+// explicitly Reload-ed or LoadCIDRFile-ed still filters correctly,
+// instead of silently allowing everyone through (blacklist mode) or
+// rejecting everyone (whitelist mode) because white/black/trust are
+// still nil. If compile fails (e.g. an invalid CIDR string), the
+// filter is marked broken rather than retrying the failing compile on
+// every subsequent request; Allow then fails closed.
+func (f *IPFilter) ensureCompiled() {
+	f.mu.RLock()
+	compiled := f.compiled
+	f.mu.RUnlock()
+	if compiled {
+		return
+	}
+	if err := f.compile(); err != nil {
+		f.mu.Lock()
+		f.compiled = true
+		f.compileBroken = true
+		f.mu.Unlock()
+	}
+}
+
+// Reload recompiles the filter's CIDR sets from its current
+// WhiteCIDRs/BlackCIDRs/TrustedProxies fields. If either list was
+// populated via LoadCIDRFile, Reload first re-reads that file from
+// disk, so editing the file and calling Reload (or sending SIGHUP via
+// ReloadOnSIGHUP) actually picks up the change. Call it after
+// mutating those fields directly, or wire it to SIGHUP.
+func (f *IPFilter) Reload() error {
+	if f.whiteCIDRFile != "" {
+		cidrs, err := readCIDRFile(f.whiteCIDRFile)
+		if err != nil {
+			return err
+		}
+		f.WhiteCIDRs = cidrs
+	}
+	if f.blackCIDRFile != "" {
+		cidrs, err := readCIDRFile(f.blackCIDRFile)
+		if err != nil {
+			return err
+		}
+		f.BlackCIDRs = cidrs
+	}
+
+	return f.compile()
+}
+
+// readCIDRFile reads a newline-separated CIDR list from path,
+// ignoring blank lines and lines starting with "#".
+func readCIDRFile(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("reverseproxy: load CIDR file: %w", err)
+	}
+	defer file.Close()
+
+	var cidrs []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		cidrs = append(cidrs, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reverseproxy: load CIDR file: %w", err)
+	}
+	return cidrs, nil
+}
+
+// LoadCIDRFile replaces WhiteCIDRs or BlackCIDRs (selected by white)
+// with the newline-separated CIDR list at path, ignoring blank lines
+// and lines starting with "#", then recompiles. The path is
+// remembered so a later Reload (including one triggered by
+// ReloadOnSIGHUP) re-reads it rather than just recompiling whatever
+// is already in memory.
+func (f *IPFilter) LoadCIDRFile(path string, white bool) error {
+	cidrs, err := readCIDRFile(path)
+	if err != nil {
+		return err
+	}
+
+	if white {
+		f.WhiteCIDRs = cidrs
+		f.whiteCIDRFile = path
+	} else {
+		f.BlackCIDRs = cidrs
+		f.blackCIDRFile = path
+	}
+
+	return f.compile()
+}
+
+// ReloadOnSIGHUP starts a goroutine that calls f.Reload whenever the
+// process receives SIGHUP, until stop is closed.
+func (f *IPFilter) ReloadOnSIGHUP(stop <-chan struct{}) {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGHUP)
+
+	go func() {
+		defer signal.Stop(sigCh)
+		for {
+			select {
+			case <-sigCh:
+				f.Reload()
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// clientIP returns the address that filtering rules should be
+// evaluated against: the XFF-chain's original client if remoteIP is a
+// trusted proxy and XFF is present, otherwise remoteIP itself.
+func (f *IPFilter) clientIP(remoteIP net.IP, xff string) net.IP {
+	f.mu.RLock()
+	trust := f.trust
+	f.mu.RUnlock()
+
+	if xff == "" || !trust.contains(remoteIP) {
+		return remoteIP
+	}
+
+	parts := strings.Split(xff, ",")
+	first := strings.TrimSpace(parts[0])
+	if ip := net.ParseIP(first); ip != nil {
+		return ip
+	}
+	return remoteIP
+}
+
+// Allow reports whether a request from remoteAddr (a host:port or
+// bare host, as from http.Request.RemoteAddr) carrying the given XFF
+// header value and request header set should be permitted.
+func (f *IPFilter) Allow(remoteAddr, xff string, header http.Header) bool {
+	if f.Mode == FilterDisabled {
+		return true
+	}
+
+	if f.MustKeyHeader != "" && header.Get(f.MustKeyHeader) == f.MustKeyValue {
+		return true
+	}
+
+	f.ensureCompiled()
+	f.mu.RLock()
+	broken := f.compileBroken
+	f.mu.RUnlock()
+	if broken {
+		return false
+	}
+
+	host := remoteAddr
+	if h, _, err := splitHostPort(remoteAddr); err == nil && h != "" {
+		host = h
+	}
+	remoteIP := net.ParseIP(host)
+	if remoteIP == nil {
+		return false
+	}
+	ip := f.clientIP(remoteIP, xff)
+
+	f.mu.RLock()
+	white, black := f.white, f.black
+	f.mu.RUnlock()
+
+	switch f.Mode {
+	case FilterWhitelist:
+		return white.contains(ip)
+	case FilterBlacklist:
+		return !black.contains(ip)
+	case FilterBoth:
+		return white.contains(ip) && !black.contains(ip)
+	default:
+		return true
+	}
+}
+
+// reject writes the filter's configured warning page (or a default
+// 403 page) to rw.
+func (f *IPFilter) reject(rw http.ResponseWriter) {
+	status := f.RejectStatus
+	if status == 0 {
+		status = http.StatusForbidden
+	}
+	body := f.RejectBody
+	if body == "" {
+		body = "<html><body><h1>403 Forbidden</h1><p>Your address is not permitted to access this resource.</p></body></html>"
+	}
+
+	rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+	rw.WriteHeader(status)
+	rw.Write([]byte(body))
+}
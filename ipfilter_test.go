@@ -0,0 +1,166 @@
+package reverseproxy
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestIPFilterAllowWhitelist(t *testing.T) {
+	f := &IPFilter{Mode: FilterWhitelist, WhiteCIDRs: []string{"192.168.1.0/24"}}
+	if err := f.Reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	if !f.Allow("192.168.1.5:1234", "", nil) {
+		t.Error("expected allow for in-range IP")
+	}
+	if f.Allow("10.0.0.5:1234", "", nil) {
+		t.Error("expected deny for out-of-range IP")
+	}
+}
+
+func TestIPFilterXFFSpoofing(t *testing.T) {
+	f := &IPFilter{
+		Mode:           FilterBlacklist,
+		BlackCIDRs:     []string{"203.0.113.0/24"},
+		TrustedProxies: []string{"127.0.0.1/32"},
+	}
+	if err := f.Reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	// An untrusted peer's claimed X-Forwarded-For must not affect
+	// filtering: only the real peer address counts.
+	if !f.Allow("198.51.100.1:1111", "203.0.113.9", nil) {
+		t.Error("spoofed X-Forwarded-For from an untrusted peer must not be honored")
+	}
+
+	// A trusted proxy's X-Forwarded-For is honored, so the blacklisted
+	// original client behind it is rejected.
+	if f.Allow("127.0.0.1:1111", "203.0.113.9", nil) {
+		t.Error("blacklisted client IP via a trusted proxy's XFF should be rejected")
+	}
+}
+
+// TestIPFilterAllowWithoutReload checks that an IPFilter built as a
+// plain struct literal, with no Reload()/LoadCIDRFile() call, filters
+// correctly from its first Allow call rather than silently defaulting
+// to allow-all (blacklist) or deny-all (whitelist) because its CIDR
+// sets were never compiled.
+func TestIPFilterAllowWithoutReload(t *testing.T) {
+	black := &IPFilter{Mode: FilterBlacklist, BlackCIDRs: []string{"10.0.0.0/8"}}
+	if black.Allow("10.1.2.3:1", "", nil) {
+		t.Error("expected deny for blacklisted IP with no Reload call")
+	}
+	if !black.Allow("192.168.1.1:1", "", nil) {
+		t.Error("expected allow for non-blacklisted IP with no Reload call")
+	}
+
+	white := &IPFilter{Mode: FilterWhitelist, WhiteCIDRs: []string{"10.0.0.0/8"}}
+	if !white.Allow("10.1.2.3:1", "", nil) {
+		t.Error("expected allow for whitelisted IP with no Reload call")
+	}
+	if white.Allow("192.168.1.1:1", "", nil) {
+		t.Error("expected deny for non-whitelisted IP with no Reload call")
+	}
+}
+
+// TestIPFilterAllowFailsClosedOnInvalidCIDR checks that an unparsable
+// CIDR string makes the filter deny every request rather than
+// retrying (and failing) the compile on every single Allow call, and
+// rather than defaulting to allow-all because white/black stayed nil.
+func TestIPFilterAllowFailsClosedOnInvalidCIDR(t *testing.T) {
+	f := &IPFilter{Mode: FilterBlacklist, BlackCIDRs: []string{"not-a-cidr"}}
+	if f.Allow("10.1.2.3:1", "", nil) {
+		t.Error("expected deny when the filter's CIDR list fails to compile")
+	}
+	if f.Allow("10.1.2.3:1", "", nil) {
+		t.Error("expected deny on a repeated call too")
+	}
+}
+
+func TestLoadCIDRFileAndReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "blacklist.conf")
+	if err := os.WriteFile(path, []byte("# comment\n203.0.113.0/24\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	f := &IPFilter{Mode: FilterBlacklist}
+	if err := f.LoadCIDRFile(path, false); err != nil {
+		t.Fatal(err)
+	}
+	if f.Allow("203.0.113.9:1111", "", nil) {
+		t.Error("expected deny for address in the loaded blacklist")
+	}
+
+	// Editing the file on disk and reloading must pick up the change,
+	// not just recompile the CIDRs already held in memory.
+	if err := os.WriteFile(path, []byte("198.51.100.0/24\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if !f.Allow("203.0.113.9:1111", "", nil) {
+		t.Error("expected allow after the on-disk blacklist dropped this range")
+	}
+	if f.Allow("198.51.100.9:1111", "", nil) {
+		t.Error("expected deny for the newly added range after reload")
+	}
+}
+
+func TestReloadOnSIGHUPRereadsFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "whitelist.conf")
+	if err := os.WriteFile(path, []byte("192.168.1.0/24\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	f := &IPFilter{Mode: FilterWhitelist}
+	if err := f.LoadCIDRFile(path, true); err != nil {
+		t.Fatal(err)
+	}
+
+	stop := make(chan struct{})
+	defer close(stop)
+	f.ReloadOnSIGHUP(stop)
+
+	if err := os.WriteFile(path, []byte("10.0.0.0/8\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Kill(os.Getpid(), syscall.SIGHUP); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if f.Allow("10.1.2.3:1111", "", nil) {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Error("expected SIGHUP to re-read the whitelist file and allow the new range")
+}
+
+func TestCIDRSetContainsIPv4AndIPv6(t *testing.T) {
+	s, err := newCIDRSet([]string{"10.0.0.0/8", "2001:db8::/32"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !s.contains(net.ParseIP("10.1.2.3")) {
+		t.Error("expected IPv4 match")
+	}
+	if s.contains(net.ParseIP("11.1.2.3")) {
+		t.Error("expected IPv4 non-match")
+	}
+	if !s.contains(net.ParseIP("2001:db8::1")) {
+		t.Error("expected IPv6 match")
+	}
+	if s.contains(net.ParseIP("2001:db9::1")) {
+		t.Error("expected IPv6 non-match")
+	}
+}
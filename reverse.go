@@ -2,12 +2,12 @@ package reverseproxy
 
 import (
 	"crypto/tls"
-	"io"
 	"log"
 	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"sync"
 	"time"
 )
 
@@ -19,12 +19,75 @@ const (
 // sends it to another server, proxying the response back to the
 // client, support http, also support https tunnel using http.hijacker
 type ReverseProxy struct {
-	// Set the timeout of the proxy server, default is 5 minutes
+	// Timeout is the idle timeout applied to CONNECT tunnels: it is
+	// reset on every successful read or write on either side of the
+	// tunnel, so an active long-lived connection is never killed
+	// outright. Default is 5 minutes.
 	Timeout time.Duration
 
+	// IPFilter, when set, is consulted before any proxying is done in
+	// both ProxyHTTP and ProxyHTTPS, including CONNECT tunnels (which
+	// are rejected before the client connection is hijacked).
+	IPFilter *IPFilter
+
+	// TrustedProxies lists the peers whose X-Forwarded-For/Forwarded
+	// headers are preserved and extended. A request from a peer not
+	// in this list has any client-supplied forwarding headers
+	// discarded before the current hop is recorded.
+	TrustedProxies []*net.IPNet
+
+	// RequestHeaders and ResponseHeaders are applied, in order, to
+	// the outbound request and the upstream response respectively.
+	RequestHeaders  []HeaderOp
+	ResponseHeaders []HeaderOp
+
+	// ModifyResponse, if set, is called after ResponseHeaders are
+	// applied and before the response is returned to the client. It
+	// is wired through to the embedded httputil.ReverseProxy.
+	ModifyResponse func(*http.Response) error
+
+	// DialTimeout bounds dialing the upstream for a CONNECT tunnel,
+	// default 10 seconds.
+	DialTimeout time.Duration
+
+	// Metrics, when set, receives byte and tunnel-count updates for
+	// every CONNECT tunnel proxied through ProxyHTTPS.
+	Metrics TunnelMetrics
+
+	// EnableHTTP2, when true, configures the underlying *http.Transport
+	// for HTTP/2 so upstreams negotiated as h2 are reused over a
+	// single multiplexed connection. Applied lazily on first use since
+	// it is typically set on the value NewReverseProxy returns.
+	EnableHTTP2 bool
+
+	target          *url.URL
+	tlsClientConfig *tls.Config
+	h2once          sync.Once
+
+	// pickTarget, when set by a constructor such as
+	// NewLoadBalancedReverseProxy that has no single static target,
+	// resolves the upstream for a websocket upgrade per request.
+	pickTarget func(*http.Request) *url.URL
+
+	healthStop     chan struct{}
+	healthStopOnce sync.Once
+
 	*httputil.ReverseProxy
 }
 
+// StopHealthChecks stops the background health-check goroutine
+// started by NewLoadBalancedReverseProxy. It is a no-op for a
+// ReverseProxy created any other way, and safe to call more than
+// once.
+func (p *ReverseProxy) StopHealthChecks() {
+	if p.healthStop == nil {
+		return
+	}
+	p.healthStopOnce.Do(func() {
+		close(p.healthStop)
+	})
+}
+
 // NewReverseProxy returns a new ReverseProxy that routes
 // URLs to the scheme, host, and base path provided in target. If the
 // target's path is "/base" and the incoming request was for "/dir",
@@ -33,21 +96,53 @@ type ReverseProxy struct {
 // will be a=10&b=100.
 // NewReverseProxy does not rewrite the Host header.
 // To rewrite Host headers, use ReverseProxy directly with a custom
-// Director policy.
+// Rewrite func.
+//
+// Unlike a bare httputil.NewSingleHostReverseProxy, the Rewrite func
+// installed here manages X-Forwarded-For, X-Forwarded-Proto,
+// X-Forwarded-Host, and RFC 7239 Forwarded headers, and strips
+// hop-by-hop headers (including any named by the client's own
+// Connection header) before forwarding. X-Forwarded-For from the
+// client is only preserved when the immediate peer is listed in
+// p.TrustedProxies; a caller may still opt a request out of
+// X-Forwarded-For entirely by setting req.Header["X-Forwarded-For"]
+// to nil before NewReverseProxy's Rewrite func runs.
 func NewReverseProxy(target *url.URL, tlsClientConfig *tls.Config) *ReverseProxy {
-	p := httputil.NewSingleHostReverseProxy(target)
+	base := httputil.NewSingleHostReverseProxy(target)
 
-	if p.Transport == nil {
-		p.Transport = http.DefaultTransport
+	if base.Transport == nil {
+		base.Transport = http.DefaultTransport
 	}
 
 	if tlsClientConfig != nil {
-		transport := p.Transport.(*http.Transport)
+		transport := base.Transport.(*http.Transport)
 		transport.TLSClientConfig = tlsClientConfig
-		p.Transport = transport
+		base.Transport = transport
 	}
 
-	return &ReverseProxy{ReverseProxy: p}
+	p := &ReverseProxy{ReverseProxy: base, target: target, tlsClientConfig: tlsClientConfig}
+
+	// Rewrite, not Director: see setForwardedHeaders.
+	base.Director = nil
+	base.Rewrite = func(pr *httputil.ProxyRequest) {
+		pr.SetURL(target)
+		pr.Out.Host = pr.In.Host
+
+		peerTrusted := trustedPeer(pr.In.RemoteAddr, p.TrustedProxies)
+		setForwardedHeaders(pr.Out, pr.In, peerTrusted)
+		removeHopByHopHeaders(pr.Out.Header)
+		applyHeaderOps(pr.Out.Header, p.RequestHeaders)
+	}
+
+	base.ModifyResponse = func(resp *http.Response) error {
+		applyHeaderOps(resp.Header, p.ResponseHeaders)
+		if p.ModifyResponse != nil {
+			return p.ModifyResponse(resp)
+		}
+		return nil
+	}
+
+	return p
 }
 
 func (p *ReverseProxy) logf(format string, args ...interface{}) {
@@ -59,66 +154,71 @@ func (p *ReverseProxy) logf(format string, args ...interface{}) {
 }
 
 func (p *ReverseProxy) ProxyHTTP(rw http.ResponseWriter, req *http.Request) {
+	if p.IPFilter != nil && !p.IPFilter.Allow(req.RemoteAddr, req.Header.Get("X-Forwarded-For"), req.Header) {
+		p.IPFilter.reject(rw)
+		return
+	}
+
+	if p.EnableHTTP2 {
+		p.configureHTTP2Once()
+	}
+
+	if isWebsocketUpgrade(req) {
+		p.ProxyWebsocket(rw, req)
+		return
+	}
+
 	p.ReverseProxy.ServeHTTP(rw, req)
 }
 
 func (p *ReverseProxy) ProxyHTTPS(rw http.ResponseWriter, req *http.Request) {
+	if p.IPFilter != nil && !p.IPFilter.Allow(req.RemoteAddr, req.Header.Get("X-Forwarded-For"), req.Header) {
+		p.IPFilter.reject(rw)
+		return
+	}
+
 	hij, ok := rw.(http.Hijacker)
 	if !ok {
 		p.logf("http server does not support hijacker")
 		return
 	}
 
-	clientConn, _, err := hij.Hijack()
+	clientConn, clientBuf, err := hij.Hijack()
 	if err != nil {
 		p.logf("http: proxy error: %v", err)
 		return
 	}
 
-	proxyConn, err := net.Dial("tcp", req.URL.Host)
+	ctx := req.Context()
+	proxyConn, err := dialUpstream(ctx, req.URL.Host, p.DialTimeout)
 	if err != nil {
 		p.logf("http: proxy error: %v", err)
+		clientConn.Close()
 		return
 	}
 
-	// The returned net.Conn may have read or write deadlines
-	// already set, depending on the configuration of the
-	// Server, to set or clear those deadlines as needed
-	// we set timeout to 5 minutes
-	deadline := time.Now()
-	if p.Timeout == 0 {
-		deadline = deadline.Add(defaultTimeout)
-	} else {
-		deadline = deadline.Add(p.Timeout)
-	}
-
-	err = clientConn.SetDeadline(deadline)
-	if err != nil {
+	if _, err := clientConn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n")); err != nil {
 		p.logf("http: proxy error: %v", err)
+		clientConn.Close()
+		proxyConn.Close()
 		return
 	}
 
-	err = proxyConn.SetDeadline(deadline)
-	if err != nil {
-		p.logf("http: proxy error: %v", err)
-		return
+	if clientBuf != nil {
+		if err := flushBuffered(clientBuf.Reader, proxyConn); err != nil {
+			p.logf("http: proxy error: %v", err)
+			clientConn.Close()
+			proxyConn.Close()
+			return
+		}
 	}
 
-	_, err = clientConn.Write([]byte("HTTP/1.0 200 OK\r\n\r\n"))
-	if err != nil {
-		p.logf("http: proxy error: %v", err)
-		return
+	idle := p.Timeout
+	if idle == 0 {
+		idle = defaultTimeout
 	}
 
-	go func() {
-		io.Copy(clientConn, proxyConn)
-		clientConn.Close()
-		proxyConn.Close()
-	}()
-
-	io.Copy(proxyConn, clientConn)
-	proxyConn.Close()
-	clientConn.Close()
+	tunnel(clientConn, proxyConn, idle, p.Metrics)
 }
 
 func (p *ReverseProxy) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
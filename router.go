@@ -0,0 +1,383 @@
+package reverseproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+)
+
+// HeaderOp describes a single add/set/remove operation applied to a
+// request or response header during routing.
+type HeaderOp struct {
+	// Op is one of "add", "set", "remove".
+	Op    string
+	Name  string
+	Value string
+}
+
+// RouteConfig describes how requests matched to a (host, location)
+// pair should be rewritten and proxied.
+type RouteConfig struct {
+	// Target is the upstream this route proxies to.
+	Target *url.URL
+
+	// HostRewrite, when non-empty, replaces the outbound Host header.
+	HostRewrite string
+
+	// PathRewrite, when non-empty, replaces the matched location
+	// prefix with this value before forwarding.
+	PathRewrite string
+
+	// CookiePathRewrite, when non-empty, rewrites the Path attribute
+	// of Set-Cookie headers in the response from CookiePathFrom to
+	// this value.
+	CookiePathFrom    string
+	CookiePathRewrite string
+
+	// Headers are applied, in order, to the outbound request.
+	Headers []HeaderOp
+
+	// ResponseHeaders are applied, in order, to the response before
+	// it is sent back to the client.
+	ResponseHeaders []HeaderOp
+
+	// TLSClientConfig, if set, is used for this route's transport
+	// instead of the router's default.
+	TLSClientConfig *tls.Config
+}
+
+// route is a registered RouteConfig bound to its (host, location) key.
+type route struct {
+	host     string
+	location string
+	cfg      RouteConfig
+	proxy    *httputil.ReverseProxy
+}
+
+// Router is a name-based virtual-host front end. It multiplexes many
+// upstream targets behind a single listener, selecting a route by the
+// longest-prefix match of the incoming request's Host and URL.Path.
+type Router struct {
+	mu     sync.RWMutex
+	routes map[string][]*route // keyed by host
+
+	// ErrorLog, when set, receives routing and reload errors.
+	ErrorLog func(format string, args ...interface{})
+
+	// IPFilter, when set, is consulted before a route is matched,
+	// exactly as in ReverseProxy.ProxyHTTP.
+	IPFilter *IPFilter
+
+	// TrustedProxies lists the peers whose X-Forwarded-For/Forwarded
+	// headers are preserved and extended, exactly as in
+	// ReverseProxy.TrustedProxies.
+	TrustedProxies []*net.IPNet
+}
+
+// NewRouter returns an empty Router ready for Register calls.
+func NewRouter() *Router {
+	return &Router{routes: make(map[string][]*route)}
+}
+
+func (r *Router) logf(format string, args ...interface{}) {
+	if r.ErrorLog != nil {
+		r.ErrorLog(format, args...)
+		return
+	}
+}
+
+// routePeerTrustedKey carries the outcome of trustedPeer(req.RemoteAddr,
+// r.TrustedProxies), computed once in Router.ServeHTTP, through to the
+// route's Rewrite func, which has no access to the Router that served
+// the request.
+type routePeerTrustedKey struct{}
+
+// newRoute builds a route for (host, location, cfg), wiring its
+// Rewrite and ModifyResponse once up front so concurrent requests
+// against the same route never race on reassigning them.
+func newRoute(host, location string, cfg RouteConfig) *route {
+	proxy := &httputil.ReverseProxy{}
+	if cfg.TLSClientConfig != nil {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = cfg.TLSClientConfig
+		proxy.Transport = transport
+	}
+
+	rt := &route{host: host, location: location, cfg: cfg, proxy: proxy}
+
+	// Rewrite, not Director: see setForwardedHeaders.
+	proxy.Rewrite = func(pr *httputil.ProxyRequest) {
+		if rt.cfg.PathRewrite != "" {
+			pr.Out.URL.Path = rt.cfg.PathRewrite + strings.TrimPrefix(pr.In.URL.Path, rt.location)
+		}
+		pr.SetURL(rt.cfg.Target)
+		pr.Out.Host = pr.In.Host
+
+		// Compute forwarded headers from pr.In, which HostRewrite below
+		// never touches, so X-Forwarded-Host reflects the virtual host
+		// the client actually requested rather than the rewritten
+		// upstream Host.
+		peerTrusted, _ := pr.In.Context().Value(routePeerTrustedKey{}).(bool)
+		setForwardedHeaders(pr.Out, pr.In, peerTrusted)
+
+		if rt.cfg.HostRewrite != "" {
+			pr.Out.Host = rt.cfg.HostRewrite
+		}
+
+		removeHopByHopHeaders(pr.Out.Header)
+		applyHeaderOps(pr.Out.Header, rt.cfg.Headers)
+	}
+
+	if len(cfg.ResponseHeaders) > 0 || cfg.CookiePathRewrite != "" {
+		proxy.ModifyResponse = func(resp *http.Response) error {
+			applyHeaderOps(resp.Header, rt.cfg.ResponseHeaders)
+			if rt.cfg.CookiePathRewrite != "" {
+				rewriteCookiePaths(resp, rt.cfg.CookiePathFrom, rt.cfg.CookiePathRewrite)
+			}
+			return nil
+		}
+	}
+
+	return rt
+}
+
+// Register adds or replaces the route for (host, location). location
+// is matched as a path prefix against incoming requests.
+func (r *Router) Register(host, location string, cfg RouteConfig) error {
+	if cfg.Target == nil {
+		return fmt.Errorf("reverseproxy: RouteConfig.Target must not be nil")
+	}
+
+	rt := newRoute(host, location, cfg)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	list := r.routes[host]
+	for i, existing := range list {
+		if existing.location == location {
+			list[i] = rt
+			return nil
+		}
+	}
+	r.routes[host] = append(list, rt)
+
+	return nil
+}
+
+// Unregister removes the route for (host, location), if present.
+func (r *Router) Unregister(host, location string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	list := r.routes[host]
+	for i, existing := range list {
+		if existing.location == location {
+			r.routes[host] = append(list[:i], list[i+1:]...)
+			return
+		}
+	}
+}
+
+// fileRoute is the on-disk representation used by ReloadFromFile.
+type fileRoute struct {
+	Host              string     `json:"host"`
+	Location          string     `json:"location"`
+	Target            string     `json:"target"`
+	HostRewrite       string     `json:"host_rewrite,omitempty"`
+	PathRewrite       string     `json:"path_rewrite,omitempty"`
+	CookiePathFrom    string     `json:"cookie_path_from,omitempty"`
+	CookiePathRewrite string     `json:"cookie_path_rewrite,omitempty"`
+	Headers           []HeaderOp `json:"headers,omitempty"`
+	ResponseHeaders   []HeaderOp `json:"response_headers,omitempty"`
+}
+
+// ReloadFromFile reads a JSON array of fileRoute entries from path and
+// atomically swaps the routing table. In-flight requests continue to
+// be served by the previous table until they return; new requests are
+// routed through the new table as soon as the swap completes.
+func (r *Router) ReloadFromFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("reverseproxy: reload: %w", err)
+	}
+
+	var entries []fileRoute
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return fmt.Errorf("reverseproxy: reload: %w", err)
+	}
+
+	next := make(map[string][]*route, len(entries))
+	for _, e := range entries {
+		target, err := url.Parse(e.Target)
+		if err != nil {
+			return fmt.Errorf("reverseproxy: reload: route %s%s: %w", e.Host, e.Location, err)
+		}
+
+		cfg := RouteConfig{
+			Target:            target,
+			HostRewrite:       e.HostRewrite,
+			PathRewrite:       e.PathRewrite,
+			CookiePathFrom:    e.CookiePathFrom,
+			CookiePathRewrite: e.CookiePathRewrite,
+			Headers:           e.Headers,
+			ResponseHeaders:   e.ResponseHeaders,
+		}
+		next[e.Host] = append(next[e.Host], newRoute(e.Host, e.Location, cfg))
+	}
+
+	r.mu.Lock()
+	r.routes = next
+	r.mu.Unlock()
+
+	return nil
+}
+
+// match returns the route with the longest-prefix location match for
+// host and path, or nil if none apply.
+func (r *Router) match(host, path string) *route {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	list := r.routes[host]
+	var best *route
+	for _, rt := range list {
+		if !matchesLocation(path, rt.location) {
+			continue
+		}
+		if best == nil || len(rt.location) > len(best.location) {
+			best = rt
+		}
+	}
+	return best
+}
+
+// matchesLocation reports whether path falls under the location
+// prefix on a path-segment boundary: location itself, or location
+// (with any trailing slash trimmed) followed by a "/". This keeps a
+// route registered at "/api" from matching an unrelated "/apidocs".
+func matchesLocation(path, location string) bool {
+	if path == location {
+		return true
+	}
+	return strings.HasPrefix(path, strings.TrimSuffix(location, "/")+"/")
+}
+
+// ServeHTTP implements http.Handler by selecting the longest-prefix
+// route for the request's Host and URL.Path, applying its rewrites,
+// and delegating to the route's reverse proxy.
+func (r *Router) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if r.IPFilter != nil && !r.IPFilter.Allow(req.RemoteAddr, req.Header.Get("X-Forwarded-For"), req.Header) {
+		r.IPFilter.reject(rw)
+		return
+	}
+
+	host := req.Host
+	if h, _, err := splitHostPort(host); err == nil {
+		host = h
+	}
+
+	rt := r.match(host, req.URL.Path)
+	if rt == nil {
+		http.NotFound(rw, req)
+		return
+	}
+
+	peerTrusted := trustedPeer(req.RemoteAddr, r.TrustedProxies)
+	req = req.WithContext(context.WithValue(req.Context(), routePeerTrustedKey{}, peerTrusted))
+
+	rt.proxy.ServeHTTP(rw, req)
+}
+
+// applyHeaderOps applies a sequence of add/set/remove operations to h.
+func applyHeaderOps(h http.Header, ops []HeaderOp) {
+	for _, op := range ops {
+		switch op.Op {
+		case "add":
+			h.Add(op.Name, op.Value)
+		case "set":
+			h.Set(op.Name, op.Value)
+		case "remove":
+			h.Del(op.Name)
+		}
+	}
+}
+
+// rewriteCookiePaths rewrites the Path attribute of any Set-Cookie
+// header in resp whose path equals from (or any path, when from is
+// empty), replacing it with to. Cookies with no Path attribute are
+// left untouched.
+func rewriteCookiePaths(resp *http.Response, from, to string) {
+	cookies := resp.Header.Values("Set-Cookie")
+	if len(cookies) == 0 {
+		return
+	}
+
+	resp.Header.Del("Set-Cookie")
+	for _, c := range cookies {
+		resp.Header.Add("Set-Cookie", replaceCookiePathAttr(c, from, to))
+	}
+}
+
+// replaceCookiePathAttr replaces the value of a Set-Cookie string's
+// Path attribute with to, provided its existing value equals from (or
+// from is empty, matching any value). Unlike a bare
+// strings.Replace(c, "Path="+from, "Path="+to, 1), this replaces the
+// whole attribute value rather than just prefixing it, so a cookie
+// that already carries a path (e.g. "Path=/old") isn't left with both
+// the new and old path concatenated (e.g. "Path=/new/old").
+func replaceCookiePathAttr(c, from, to string) string {
+	valStart, valEnd, ok := findCookieAttr(c, "Path=")
+	if !ok {
+		return c
+	}
+	if from != "" && c[valStart:valEnd] != from {
+		return c
+	}
+	return c[:valStart] + to + c[valEnd:]
+}
+
+// findCookieAttr locates attr (e.g. "Path=") as an actual cookie
+// attribute in a Set-Cookie string c - at the start of c, or right
+// after a ";" (with optional spaces) - rather than matching it as a
+// bare substring anywhere, so a cookie name/value that merely contains
+// attr's text (e.g. a value of "XPath=abc") is never mistaken for the
+// attribute itself. It returns the bounds of the attribute's value,
+// up to the next ";" or the end of c.
+func findCookieAttr(c, attr string) (valStart, valEnd int, ok bool) {
+	for offset := 0; ; {
+		i := strings.Index(c[offset:], attr)
+		if i == -1 {
+			return 0, 0, false
+		}
+		i += offset
+
+		if i == 0 || strings.HasSuffix(strings.TrimRight(c[:i], " "), ";") {
+			valStart = i + len(attr)
+			valEnd = len(c)
+			if rel := strings.IndexByte(c[valStart:], ';'); rel != -1 {
+				valEnd = valStart + rel
+			}
+			return valStart, valEnd, true
+		}
+
+		offset = i + len(attr)
+	}
+}
+
+// splitHostPort splits "host:port" into host, port. Unlike
+// net.SplitHostPort it tolerates a bare host with no port.
+func splitHostPort(hostport string) (host, port string, err error) {
+	if i := strings.LastIndex(hostport, ":"); i != -1 && !strings.Contains(hostport[i+1:], "]") {
+		return hostport[:i], hostport[i+1:], nil
+	}
+	return hostport, "", nil
+}
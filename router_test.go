@@ -0,0 +1,188 @@
+package reverseproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+)
+
+func TestMatchesLocation(t *testing.T) {
+	cases := []struct {
+		path, location string
+		want           bool
+	}{
+		{"/api", "/api", true},
+		{"/api/", "/api", true},
+		{"/api/v1", "/api", true},
+		{"/apidocs-admin", "/api", false},
+		{"/other", "/api", false},
+	}
+	for _, c := range cases {
+		if got := matchesLocation(c.path, c.location); got != c.want {
+			t.Errorf("matchesLocation(%q, %q) = %v, want %v", c.path, c.location, got, c.want)
+		}
+	}
+}
+
+// TestRouterConcurrentResponseHeaders exercises a route with
+// ResponseHeaders set from many goroutines at once; run with -race it
+// catches ModifyResponse being reassigned per-request instead of once
+// at registration.
+func TestRouterConcurrentResponseHeaders(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer upstream.Close()
+
+	target, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewRouter()
+	if err := r.Register("example.com", "/api", RouteConfig{
+		Target:          target,
+		ResponseHeaders: []HeaderOp{{Op: "set", Name: "X-Test", Value: "1"}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req := httptest.NewRequest(http.MethodGet, "/api/x", nil)
+			req.Host = "example.com"
+			rw := httptest.NewRecorder()
+			r.ServeHTTP(rw, req)
+			if rw.Header().Get("X-Test") != "1" {
+				t.Errorf("missing X-Test response header")
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// TestRouterCookiePathRewrite checks that rewriting an upstream
+// cookie's Path attribute replaces the whole existing value rather
+// than prefixing it, for both a bare CookiePathRewrite (rewrite
+// whatever path is present) and a CookiePathFrom-scoped rewrite.
+func TestRouterCookiePathRewrite(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Set-Cookie", "session=abc; Path=/old; HttpOnly")
+		w.Write([]byte("ok"))
+	}))
+	defer upstream.Close()
+
+	target, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewRouter()
+	if err := r.Register("example.com", "/", RouteConfig{
+		Target:            target,
+		CookiePathRewrite: "/new",
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Host = "example.com"
+	rw := httptest.NewRecorder()
+	r.ServeHTTP(rw, req)
+
+	if want := "session=abc; Path=/new; HttpOnly"; rw.Header().Get("Set-Cookie") != want {
+		t.Errorf("Set-Cookie = %q, want %q", rw.Header().Get("Set-Cookie"), want)
+	}
+}
+
+// TestRouterHostRewritePreservesOriginalXForwardedHost checks that a
+// route's HostRewrite, which replaces the outbound Host header for the
+// upstream, does not leak into X-Forwarded-Host: backends doing
+// canonical-URL or redirect generation need the virtual host the
+// client actually requested, not the internal rewritten one.
+func TestRouterHostRewritePreservesOriginalXForwardedHost(t *testing.T) {
+	var gotHost, gotXFH string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotHost = r.Host
+		gotXFH = r.Header.Get("X-Forwarded-Host")
+		w.Write([]byte("ok"))
+	}))
+	defer upstream.Close()
+
+	target, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewRouter()
+	if err := r.Register("public.example.com", "/", RouteConfig{
+		Target:      target,
+		HostRewrite: target.Host,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Host = "public.example.com"
+	rw := httptest.NewRecorder()
+	r.ServeHTTP(rw, req)
+
+	if gotHost != target.Host {
+		t.Errorf("upstream saw Host = %q, want HostRewrite target %q", gotHost, target.Host)
+	}
+	if gotXFH != "public.example.com" {
+		t.Errorf("X-Forwarded-Host = %q, want original virtual host %q", gotXFH, "public.example.com")
+	}
+}
+
+func TestReplaceCookiePathAttr(t *testing.T) {
+	cases := []struct {
+		name, cookie, from, to, want string
+	}{
+		{"replaces existing path", "session=abc; Path=/old; HttpOnly", "", "/new", "session=abc; Path=/new; HttpOnly"},
+		{"replaces trailing path with no other attrs", "session=abc; Path=/old", "", "/new", "session=abc; Path=/new"},
+		{"scoped from matches", "session=abc; Path=/old", "/old", "/new", "session=abc; Path=/new"},
+		{"scoped from does not match", "session=abc; Path=/other", "/old", "/new", "session=abc; Path=/other"},
+		{"no path attribute", "session=abc; HttpOnly", "", "/new", "session=abc; HttpOnly"},
+		{"cookie value containing Path= is not mistaken for the attribute", "data=XPath=abc; HttpOnly", "", "/new", "data=XPath=abc; HttpOnly"},
+		{"first attribute named Path", "Path=/old; HttpOnly", "", "/new", "Path=/new; HttpOnly"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := replaceCookiePathAttr(c.cookie, c.from, c.to); got != c.want {
+				t.Errorf("replaceCookiePathAttr(%q, %q, %q) = %q, want %q", c.cookie, c.from, c.to, got, c.want)
+			}
+		})
+	}
+}
+
+func TestRouterIPFilterRejects(t *testing.T) {
+	target, err := url.Parse("http://127.0.0.1:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewRouter()
+	if err := r.Register("example.com", "/", RouteConfig{Target: target}); err != nil {
+		t.Fatal(err)
+	}
+	r.IPFilter = &IPFilter{Mode: FilterBlacklist, BlackCIDRs: []string{"10.0.0.0/8"}}
+	if err := r.IPFilter.Reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Host = "example.com"
+	req.RemoteAddr = "10.1.2.3:5555"
+	rw := httptest.NewRecorder()
+	r.ServeHTTP(rw, req)
+
+	if rw.Code != http.StatusForbidden {
+		t.Errorf("expected %d, got %d", http.StatusForbidden, rw.Code)
+	}
+}
@@ -0,0 +1,169 @@
+package reverseproxy
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultDialTimeout = time.Second * 10
+)
+
+// TunnelMetrics receives counters for CONNECT tunnels so callers can
+// plug in Prometheus or any other collector. All methods must be
+// safe for concurrent use.
+type TunnelMetrics interface {
+	// TunnelOpened is called once a tunnel's halves start copying.
+	TunnelOpened()
+	// TunnelClosed is called once both directions of a tunnel finish.
+	TunnelClosed()
+	// AddBytesIn records bytes read from the client and written
+	// upstream.
+	AddBytesIn(n int64)
+	// AddBytesOut records bytes read from the upstream and written
+	// to the client.
+	AddBytesOut(n int64)
+}
+
+// TunnelCounters is a simple atomic-counter TunnelMetrics
+// implementation good enough for /debug style inspection; callers
+// wanting Prometheus labels should implement TunnelMetrics directly.
+type TunnelCounters struct {
+	BytesIn       int64
+	BytesOut      int64
+	ActiveTunnels int64
+}
+
+func (c *TunnelCounters) TunnelOpened()       { atomic.AddInt64(&c.ActiveTunnels, 1) }
+func (c *TunnelCounters) TunnelClosed()       { atomic.AddInt64(&c.ActiveTunnels, -1) }
+func (c *TunnelCounters) AddBytesIn(n int64)  { atomic.AddInt64(&c.BytesIn, n) }
+func (c *TunnelCounters) AddBytesOut(n int64) { atomic.AddInt64(&c.BytesOut, n) }
+
+// deadlineConn wraps a net.Conn and resets an idle deadline on every
+// successful Read or Write, so a long-lived but active tunnel is
+// never killed by a fixed wall-clock timeout.
+type deadlineConn struct {
+	net.Conn
+	idle time.Duration
+}
+
+func newDeadlineConn(c net.Conn, idle time.Duration) *deadlineConn {
+	dc := &deadlineConn{Conn: c, idle: idle}
+	dc.bump()
+	return dc
+}
+
+func (c *deadlineConn) bump() {
+	if c.idle > 0 {
+		c.Conn.SetDeadline(time.Now().Add(c.idle))
+	}
+}
+
+func (c *deadlineConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if err == nil {
+		c.bump()
+	}
+	return n, err
+}
+
+func (c *deadlineConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if err == nil {
+		c.bump()
+	}
+	return n, err
+}
+
+// halfCloser is implemented by connections that support shutting down
+// only the write half, such as *net.TCPConn and *tls.Conn.
+type halfCloser interface {
+	CloseWrite() error
+}
+
+// closeWrite shuts down the write half of conn if it supports doing
+// so, unwrapping a *deadlineConn first.
+func closeWrite(conn net.Conn) error {
+	if dc, ok := conn.(*deadlineConn); ok {
+		conn = dc.Conn
+	}
+	if hc, ok := conn.(halfCloser); ok {
+		return hc.CloseWrite()
+	}
+	return conn.Close()
+}
+
+// tunnel splices client and upstream, recording byte counts to
+// metrics (if non-nil), and half-closing each side as its copy
+// direction finishes. It returns once both directions have
+// completed.
+func tunnel(client, upstream net.Conn, idle time.Duration, metrics TunnelMetrics) {
+	clientConn := newDeadlineConn(client, idle)
+	upstreamConn := newDeadlineConn(upstream, idle)
+
+	if metrics != nil {
+		metrics.TunnelOpened()
+		defer metrics.TunnelClosed()
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	go func() {
+		defer wg.Done()
+		n, _ := io.Copy(upstreamConn, clientConn)
+		if metrics != nil {
+			metrics.AddBytesIn(n)
+		}
+		closeWrite(upstream)
+	}()
+
+	go func() {
+		defer wg.Done()
+		n, _ := io.Copy(clientConn, upstreamConn)
+		if metrics != nil {
+			metrics.AddBytesOut(n)
+		}
+		closeWrite(client)
+	}()
+
+	wg.Wait()
+
+	client.Close()
+	upstream.Close()
+}
+
+// dialUpstream connects to addr honoring dialTimeout (defaulting to
+// defaultDialTimeout) and ctx cancellation.
+func dialUpstream(ctx context.Context, addr string, dialTimeout time.Duration) (net.Conn, error) {
+	if dialTimeout == 0 {
+		dialTimeout = defaultDialTimeout
+	}
+	d := &net.Dialer{Timeout: dialTimeout}
+	return d.DialContext(ctx, "tcp", addr)
+}
+
+// flushBuffered writes any client bytes already buffered by Hijack's
+// bufio.ReadWriter into upstream before the tunnel starts copying, so
+// bytes the client sent immediately after CONNECT (pipelining) aren't
+// lost.
+func flushBuffered(br *bufio.Reader, upstream net.Conn) error {
+	if br == nil {
+		return nil
+	}
+	if n := br.Buffered(); n > 0 {
+		buffered := make([]byte, n)
+		if _, err := io.ReadFull(br, buffered); err != nil {
+			return err
+		}
+		if _, err := upstream.Write(buffered); err != nil {
+			return err
+		}
+	}
+	return nil
+}
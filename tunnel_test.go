@@ -0,0 +1,223 @@
+package reverseproxy
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// fakeConn is a minimal net.Conn that records every deadline set on
+// it, so deadlineConn's idle-reset behavior can be checked without
+// timing-sensitive sleeps against a real connection.
+type fakeConn struct {
+	net.Conn
+	deadlines []time.Time
+}
+
+func (c *fakeConn) SetDeadline(t time.Time) error {
+	c.deadlines = append(c.deadlines, t)
+	return nil
+}
+
+func (c *fakeConn) Read(b []byte) (int, error)  { return len(b), nil }
+func (c *fakeConn) Write(b []byte) (int, error) { return len(b), nil }
+
+func TestDeadlineConnBumpsOnRead(t *testing.T) {
+	fc := &fakeConn{}
+	dc := newDeadlineConn(fc, time.Minute)
+	if len(fc.deadlines) != 1 {
+		t.Fatalf("expected newDeadlineConn to set an initial deadline, got %d", len(fc.deadlines))
+	}
+	first := fc.deadlines[0]
+
+	time.Sleep(time.Millisecond)
+	if _, err := dc.Read(make([]byte, 4)); err != nil {
+		t.Fatal(err)
+	}
+	if len(fc.deadlines) != 2 {
+		t.Fatalf("expected Read to bump the deadline, got %d calls", len(fc.deadlines))
+	}
+	if !fc.deadlines[1].After(first) {
+		t.Error("expected the deadline after Read to be later than the initial one")
+	}
+}
+
+func TestDeadlineConnBumpsOnWrite(t *testing.T) {
+	fc := &fakeConn{}
+	dc := newDeadlineConn(fc, time.Minute)
+	first := fc.deadlines[0]
+
+	time.Sleep(time.Millisecond)
+	if _, err := dc.Write([]byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	if len(fc.deadlines) != 2 {
+		t.Fatalf("expected Write to bump the deadline, got %d calls", len(fc.deadlines))
+	}
+	if !fc.deadlines[1].After(first) {
+		t.Error("expected the deadline after Write to be later than the initial one")
+	}
+}
+
+func TestDeadlineConnZeroIdleNeverSetsDeadline(t *testing.T) {
+	fc := &fakeConn{}
+	dc := newDeadlineConn(fc, 0)
+	if len(fc.deadlines) != 0 {
+		t.Fatalf("expected no deadline with idle=0, got %d calls", len(fc.deadlines))
+	}
+	if _, err := dc.Read(make([]byte, 4)); err != nil {
+		t.Fatal(err)
+	}
+	if len(fc.deadlines) != 0 {
+		t.Error("expected Read with idle=0 not to set a deadline")
+	}
+}
+
+func TestCloseWriteHalfClosesTCPConn(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	serverDone := make(chan error, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			serverDone <- err
+			return
+		}
+		defer conn.Close()
+
+		// The peer's CloseWrite should surface as an EOF here, while
+		// this side can still write back.
+		buf := make([]byte, 16)
+		n, err := conn.Read(buf)
+		if err != nil && err != io.EOF {
+			serverDone <- err
+			return
+		}
+		if n != 0 {
+			serverDone <- nil
+			return
+		}
+		if _, err := conn.Write([]byte("still-open")); err != nil {
+			serverDone <- err
+			return
+		}
+		serverDone <- nil
+	}()
+
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	if err := closeWrite(client); err != nil {
+		t.Fatalf("closeWrite: %v", err)
+	}
+
+	// The read half must still work: the server's reply should arrive.
+	buf := make([]byte, 32)
+	client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, err := client.Read(buf)
+	if err != nil {
+		t.Fatalf("expected to still read after closeWrite half-closed only the write side: %v", err)
+	}
+	if string(buf[:n]) != "still-open" {
+		t.Errorf("got %q, want %q", buf[:n], "still-open")
+	}
+
+	if err := <-serverDone; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCloseWriteFallsBackToCloseWithoutHalfClose(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+
+	readDone := make(chan error, 1)
+	go func() {
+		_, err := server.Read(make([]byte, 1))
+		readDone <- err
+	}()
+
+	// net.Pipe conns don't implement CloseWrite, so closeWrite must
+	// fall back to a full Close.
+	if err := closeWrite(client); err != nil {
+		t.Fatalf("closeWrite: %v", err)
+	}
+
+	if err := <-readDone; err != io.EOF && err != io.ErrClosedPipe {
+		t.Errorf("expected the peer to observe the connection closing, got %v", err)
+	}
+}
+
+func TestCloseWriteUnwrapsDeadlineConn(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+
+	dc := newDeadlineConn(client, time.Minute)
+
+	readDone := make(chan error, 1)
+	go func() {
+		_, err := server.Read(make([]byte, 1))
+		readDone <- err
+	}()
+
+	if err := closeWrite(dc); err != nil {
+		t.Fatalf("closeWrite: %v", err)
+	}
+	if err := <-readDone; err != io.EOF && err != io.ErrClosedPipe {
+		t.Errorf("expected the peer to observe the connection closing, got %v", err)
+	}
+}
+
+func TestTunnelCopiesBothDirectionsAndCounts(t *testing.T) {
+	clientSide, proxyClientSide := net.Pipe()
+	upstreamSide, proxyUpstreamSide := net.Pipe()
+
+	metrics := &TunnelCounters{}
+	done := make(chan struct{})
+	go func() {
+		tunnel(proxyClientSide, proxyUpstreamSide, 0, metrics)
+		close(done)
+	}()
+
+	go func() {
+		buf := make([]byte, 16)
+		n, _ := upstreamSide.Read(buf)
+		upstreamSide.Write(buf[:n])
+		upstreamSide.Close()
+	}()
+
+	if _, err := clientSide.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 16)
+	clientSide.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, err := clientSide.Read(buf)
+	if err != nil {
+		t.Fatalf("expected the echoed bytes back through the tunnel: %v", err)
+	}
+	if string(buf[:n]) != "ping" {
+		t.Errorf("got %q, want %q", buf[:n], "ping")
+	}
+
+	clientSide.Close()
+	<-done
+
+	if metrics.ActiveTunnels != 0 {
+		t.Errorf("ActiveTunnels = %d, want 0 after the tunnel closed", metrics.ActiveTunnels)
+	}
+	if metrics.BytesIn == 0 {
+		t.Error("expected BytesIn to be recorded")
+	}
+	if metrics.BytesOut == 0 {
+		t.Error("expected BytesOut to be recorded")
+	}
+}
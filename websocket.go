@@ -0,0 +1,130 @@
+package reverseproxy
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// isWebsocketUpgrade reports whether req is an HTTP Upgrade request
+// for the websocket protocol, per RFC 6455 §4.1.
+func isWebsocketUpgrade(req *http.Request) bool {
+	return headerContainsToken(req.Header, "Connection", "upgrade") &&
+		strings.EqualFold(req.Header.Get("Upgrade"), "websocket")
+}
+
+// headerContainsToken reports whether any comma-separated value of
+// header name in h equals token, case-insensitively.
+func headerContainsToken(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, part := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(part), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ProxyWebsocket hijacks the client connection, dials the upstream,
+// replays the Upgrade request, and then splices the two connections
+// together exactly like a CONNECT tunnel. Sec-WebSocket-* and Origin
+// headers are forwarded unmodified so the upstream sees the original
+// handshake.
+func (p *ReverseProxy) ProxyWebsocket(rw http.ResponseWriter, req *http.Request) {
+	target := p.target
+	if p.pickTarget != nil {
+		target = p.pickTarget(req)
+	}
+	if target == nil {
+		http.Error(rw, "bad gateway", http.StatusBadGateway)
+		return
+	}
+
+	hij, ok := rw.(http.Hijacker)
+	if !ok {
+		p.logf("http server does not support hijacker")
+		return
+	}
+
+	clientConn, clientBuf, err := hij.Hijack()
+	if err != nil {
+		p.logf("websocket: proxy error: %v", err)
+		return
+	}
+
+	upstream, err := p.dialWebsocketUpstream(req, target)
+	if err != nil {
+		p.logf("websocket: proxy error: %v", err)
+		clientConn.Close()
+		return
+	}
+
+	outreq := req.Clone(req.Context())
+	outreq.URL.Scheme = target.Scheme
+	outreq.URL.Host = target.Host
+	outreq.Host = target.Host
+	outreq.RequestURI = ""
+
+	peerTrusted := trustedPeer(req.RemoteAddr, p.TrustedProxies)
+	setForwardedHeaders(outreq, req, peerTrusted)
+	if req.TLS != nil {
+		outreq.Header.Set("X-Forwarded-Proto", "wss")
+	} else {
+		outreq.Header.Set("X-Forwarded-Proto", "ws")
+	}
+	applyHeaderOps(outreq.Header, p.RequestHeaders)
+
+	if err := outreq.Write(upstream); err != nil {
+		p.logf("websocket: proxy error: %v", err)
+		clientConn.Close()
+		upstream.Close()
+		return
+	}
+
+	if clientBuf != nil {
+		if err := flushBuffered(clientBuf.Reader, upstream); err != nil {
+			p.logf("websocket: proxy error: %v", err)
+			clientConn.Close()
+			upstream.Close()
+			return
+		}
+	}
+
+	idle := p.Timeout
+	if idle == 0 {
+		idle = defaultTimeout
+	}
+
+	tunnel(clientConn, upstream, idle, p.Metrics)
+}
+
+// dialWebsocketUpstream opens a TCP or TLS connection to target
+// depending on its scheme (ws/http vs wss/https).
+func (p *ReverseProxy) dialWebsocketUpstream(req *http.Request, target *url.URL) (net.Conn, error) {
+	addr := target.Host
+	if !strings.Contains(addr, ":") {
+		if target.Scheme == "wss" || target.Scheme == "https" {
+			addr = net.JoinHostPort(addr, "443")
+		} else {
+			addr = net.JoinHostPort(addr, "80")
+		}
+	}
+
+	if target.Scheme == "wss" || target.Scheme == "https" {
+		conn, err := dialUpstream(req.Context(), addr, p.DialTimeout)
+		if err != nil {
+			return nil, err
+		}
+		tlsConn := tls.Client(conn, p.tlsClientConfig)
+		if err := tlsConn.HandshakeContext(req.Context()); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return tlsConn, nil
+	}
+
+	return dialUpstream(req.Context(), addr, p.DialTimeout)
+}